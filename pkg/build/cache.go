@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// goEnvCache caches the handful of `go env` variables buildContext cares about.
+// They're process-wide (they depend on the installed toolchain, not on any
+// particular module), so there's no reason to shell out to `go env` once per
+// Build invocation.
+var (
+	goEnvMu    sync.Mutex
+	goEnvCache map[string]string
+)
+
+// goEnvVars returns the cached `go env` values, populating the cache on
+// first use with a single `go env -json` call. A failed call isn't cached,
+// so a transient error (e.g. during process startup) doesn't wedge every
+// later build in a long-running `ko` process.
+func goEnvVars(ctx context.Context) (map[string]string, error) {
+	goEnvMu.Lock()
+	defer goEnvMu.Unlock()
+
+	if goEnvCache != nil {
+		return goEnvCache, nil
+	}
+
+	inv := &Invocation{
+		Verb: "env",
+		Args: []string{"-json", "GOROOT", "GOPATH", "GOMODCACHE", "GOFLAGS", "GOWORK"},
+	}
+	stdout, _, err := inv.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	env := map[string]string{}
+	if err := json.Unmarshal(stdout.Bytes(), &env); err != nil {
+		return nil, err
+	}
+	goEnvCache = env
+	return goEnvCache, nil
+}
+
+// moduleInfoCache deduplicates concurrent `go list -m all` calls for the
+// same module graph, and remembers the result so that a `ko resolve` over
+// many images in the same module only pays for it once.
+var (
+	moduleInfoGroup singleflight.Group
+	moduleInfoMu    sync.Mutex
+	moduleInfoCache = map[string]*modules{}
+)
+
+// modRootFiles resolves the go.mod and go.work files that actually govern
+// dir, via `go env GOMOD GOWORK` -- dir is routinely a package subdirectory
+// with no go.mod of its own, so we can't just assume the files we need to
+// watch live in dir itself.
+func modRootFiles(ctx context.Context, dir string) (gomod, gowork string) {
+	inv := &Invocation{Verb: "env", Args: []string{"-json", "GOMOD", "GOWORK"}, Dir: dir}
+	stdout, _, err := inv.Run(ctx)
+	if err != nil {
+		return "", ""
+	}
+	var env struct{ GOMOD, GOWORK string }
+	if err := json.Unmarshal(stdout.Bytes(), &env); err != nil {
+		return "", ""
+	}
+	return env.GOMOD, env.GOWORK
+}
+
+// moduleInfoCacheKey identifies a module graph by its resolved root -- the
+// directory containing go.mod, or the one containing go.work if there's no
+// go.mod --
+// plus the mtimes of the files that govern it. Keying on the resolved root
+// rather than the caller-supplied dir means two different package
+// directories in the same module (e.g. cmd/a and cmd/b) share one cache
+// entry instead of each triggering their own `go list -m all`. If none of
+// go.mod, go.sum, or go.work have changed on disk, a cached result from an
+// earlier, concurrent build is reused instead of re-running `go list`.
+func moduleInfoCacheKey(ctx context.Context, dir string) string {
+	gomod, gowork := modRootFiles(ctx, dir)
+
+	mtime := func(path string) string {
+		if path == "" || path == os.DevNull {
+			return ""
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return ""
+		}
+		return fi.ModTime().String()
+	}
+
+	root := dir
+	gosum := ""
+	switch {
+	case gomod != "" && gomod != os.DevNull:
+		root = filepath.Dir(gomod)
+		gosum = filepath.Join(root, "go.sum")
+	case gowork != "":
+		root = filepath.Dir(gowork)
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%s", root, mtime(gomod), mtime(gosum), mtime(gowork))
+}
+
+// cachedModuleInfo runs load (a `go list -m all` invocation) until it first
+// succeeds for a moduleInfoCacheKey, sharing the result across concurrent
+// callers and across later calls for a module graph that hasn't changed on
+// disk. An error or a nil result is not cached, so the next call runs load
+// again.
+func cachedModuleInfo(ctx context.Context, dir string, load func() (*modules, error)) (*modules, error) {
+	key := moduleInfoCacheKey(ctx, dir)
+
+	moduleInfoMu.Lock()
+	if cached, ok := moduleInfoCache[key]; ok {
+		moduleInfoMu.Unlock()
+		return cached, nil
+	}
+	moduleInfoMu.Unlock()
+
+	v, err, _ := moduleInfoGroup.Do(key, func() (interface{}, error) {
+		mods, err := load()
+		if err != nil {
+			return nil, err
+		}
+		if mods == nil {
+			// load() returning (nil, nil) means it couldn't determine module
+			// info (e.g. a failed `go list`), not that there are definitely
+			// no modules -- don't cache that as a success, or a transient
+			// failure would wedge every later call in this process.
+			return nil, nil
+		}
+		moduleInfoMu.Lock()
+		moduleInfoCache[key] = mods
+		moduleInfoMu.Unlock()
+		return mods, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+	return v.(*modules), nil
+}
+
+// InvalidateCache clears the cached `go env` values and module graphs. Long-
+// running `ko` server modes should call this whenever the underlying
+// checkout may have changed on disk in a way the mtime-based cache key can't
+// observe (e.g. a branch switch that doesn't touch go.mod/go.sum/go.work).
+func InvalidateCache() {
+	goEnvMu.Lock()
+	goEnvCache = nil
+	goEnvMu.Unlock()
+
+	moduleInfoMu.Lock()
+	moduleInfoCache = map[string]*modules{}
+	moduleInfoMu.Unlock()
+}
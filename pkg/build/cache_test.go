@@ -0,0 +1,166 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestModule creates a temp module with a nested package subdirectory and
+// returns the module root and the subdirectory path.
+func newTestModule(t *testing.T) (root, pkgDir string) {
+	t.Helper()
+	root = t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/testmod\n\ngo 1.21\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pkgDir = filepath.Join(root, "pkg", "sub")
+	if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, "sub.go"), []byte("package sub\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root, pkgDir
+}
+
+// addTestPackage creates an additional package subdirectory under root.
+func addTestPackage(t *testing.T, root, relDir string) string {
+	t.Helper()
+	dir := filepath.Join(root, relDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pkg.go"), []byte("package pkg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestModuleInfoCacheKeySharedAcrossPackagesInSameModule(t *testing.T) {
+	root, pkgA := newTestModule(t)
+	pkgB := addTestPackage(t, root, filepath.Join("cmd", "b"))
+	ctx := context.Background()
+
+	keyA := moduleInfoCacheKey(ctx, pkgA)
+	keyB := moduleInfoCacheKey(ctx, pkgB)
+	if keyA != keyB {
+		t.Errorf("moduleInfoCacheKey(%q) = %q, moduleInfoCacheKey(%q) = %q, want the same key for two packages in the same module", pkgA, keyA, pkgB, keyB)
+	}
+}
+
+func TestModuleInfoCacheKeyTracksResolvedModuleRoot(t *testing.T) {
+	root, pkgDir := newTestModule(t)
+	ctx := context.Background()
+
+	before := moduleInfoCacheKey(ctx, pkgDir)
+
+	// Touch go.mod in the resolved module root, not pkgDir, and make sure
+	// its mtime visibly changes.
+	time.Sleep(10 * time.Millisecond)
+	gomod := filepath.Join(root, "go.mod")
+	contents, err := os.ReadFile(gomod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gomod, append(contents, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	after := moduleInfoCacheKey(ctx, pkgDir)
+	if before == after {
+		t.Fatalf("moduleInfoCacheKey(%q) did not change after editing the resolved module's go.mod; got %q both times", pkgDir, before)
+	}
+}
+
+func TestCachedModuleInfoDoesNotCacheNilResult(t *testing.T) {
+	_, pkgDir := newTestModule(t)
+	ctx := context.Background()
+
+	calls := 0
+	load := func() (*modules, error) {
+		calls++
+		return nil, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		mods, err := cachedModuleInfo(ctx, pkgDir, load)
+		if err != nil {
+			t.Fatalf("cachedModuleInfo() error = %v", err)
+		}
+		if mods != nil {
+			t.Fatalf("cachedModuleInfo() = %v, want nil", mods)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("load was called %d times, want 3 (a nil result must never be cached)", calls)
+	}
+}
+
+func TestCachedModuleInfoDoesNotCacheError(t *testing.T) {
+	_, pkgDir := newTestModule(t)
+	ctx := context.Background()
+
+	wantErr := errors.New("transient failure")
+	calls := 0
+	load := func() (*modules, error) {
+		calls++
+		if calls == 1 {
+			return nil, wantErr
+		}
+		return &modules{mains: []*modInfo{{Path: "example.com/testmod", Dir: pkgDir, Main: true}}}, nil
+	}
+
+	if _, err := cachedModuleInfo(ctx, pkgDir, load); !errors.Is(err, wantErr) {
+		t.Fatalf("first cachedModuleInfo() error = %v, want %v", err, wantErr)
+	}
+	mods, err := cachedModuleInfo(ctx, pkgDir, load)
+	if err != nil {
+		t.Fatalf("second cachedModuleInfo() error = %v, want nil", err)
+	}
+	if mods == nil {
+		t.Fatal("second cachedModuleInfo() = nil, want a successful result")
+	}
+	if calls != 2 {
+		t.Errorf("load was called %d times, want 2 (an error result must not be cached)", calls)
+	}
+}
+
+func TestCachedModuleInfoSharesSuccessfulResult(t *testing.T) {
+	_, pkgDir := newTestModule(t)
+	ctx := context.Background()
+
+	calls := 0
+	load := func() (*modules, error) {
+		calls++
+		return &modules{mains: []*modInfo{{Path: "example.com/testmod", Dir: pkgDir, Main: true}}}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cachedModuleInfo(ctx, pkgDir, load); err != nil {
+			t.Fatalf("cachedModuleInfo() error = %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("load was called %d times, want 1 (a successful result should be cached)", calls)
+	}
+}
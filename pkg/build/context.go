@@ -24,7 +24,8 @@ import (
 	gb "go/build"
 	"io"
 	"log"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/tools/go/packages"
@@ -50,8 +51,41 @@ For more information see:
 
 // https://golang.org/pkg/cmd/go/internal/modinfo/#ModulePublic
 type modules struct {
-	main *modInfo
-	deps map[string]*modInfo
+	// mains holds every main module known to the build context. In ordinary
+	// (single-module) mode this is a single entry; in `go.work` workspace
+	// mode it holds one entry per `use` directive.
+	mains []*modInfo
+	deps  map[string]*modInfo
+}
+
+// mainModuleForDir returns the main module that owns dir, i.e. the main
+// module whose root directory is dir or a parent of dir. In workspace mode
+// more than one main module may be loaded at once, so callers that need to
+// resolve importpaths or stamp module info must pick the one that actually
+// contains the package being built rather than assuming there is only one.
+func (m *modules) mainModuleForDir(dir string) *modInfo {
+	var best *modInfo
+	for _, main := range m.mains {
+		if main.Dir == "" {
+			continue
+		}
+		// Require a path-separator boundary (or an exact match) so that a
+		// sibling directory sharing a string prefix -- e.g. "/ws/foobar"
+		// under a module rooted at "/ws/foo" -- isn't misattributed.
+		if dir != main.Dir && !strings.HasPrefix(dir, main.Dir+string(filepath.Separator)) {
+			continue
+		}
+		if best == nil || len(main.Dir) > len(best.Dir) {
+			best = main
+		}
+	}
+	if best == nil && len(m.mains) > 0 {
+		// Fall back to the first main module, matching prior behavior for
+		// single-module checkouts where dir might not be an exact prefix
+		// match (e.g. symlinked GOPATH trees).
+		return m.mains[0]
+	}
+	return best
 }
 
 type modInfo struct {
@@ -61,9 +95,9 @@ type modInfo struct {
 }
 
 type buildContext interface {
-	importPackage(path string, srcDir string) (*gb.Package, error)
+	importPackage(ctx context.Context, path string, srcDir string) (*gb.Package, error)
 	moduleInfo(ctx context.Context) (*modules, error)
-	qualifyLocalImport(importpath string) (string, error)
+	qualifyLocalImport(ctx context.Context, importpath string) (string, error)
 }
 
 type goBuildContext struct {
@@ -72,8 +106,16 @@ type goBuildContext struct {
 	bc gb.Context
 }
 
-// newBuildContext creates a new buildContext, which wraps a go/build.Context.
+// newBuildContext creates a new buildContext. If GOPACKAGESDRIVER is set to
+// anything other than "off", it returns a driverBuildContext that sources
+// package and module info through the configured driver (e.g. Bazel's
+// gopackagesdriver) instead of go/build and `go list`. Otherwise it returns
+// a goBuildContext, which wraps a go/build.Context.
 func newBuildContext(ctx context.Context, dir string) (buildContext, error) {
+	if driver := os.Getenv("GOPACKAGESDRIVER"); driver != "" && driver != "off" {
+		return newDriverBuildContext(dir), nil
+	}
+
 	g := &goBuildContext{
 		bc: gb.Default,
 	}
@@ -81,7 +123,7 @@ func newBuildContext(ctx context.Context, dir string) (buildContext, error) {
 
 	// If $(go env GOROOT) successfully returns a non-empty string that differs from
 	// the default build context GOROOT, print a warning and use $(go env GOROOT).
-	goroot, err := getGoroot(ctx, dir)
+	goroot, err := getGoroot(ctx)
 	if err != nil {
 		// On error, print the output and set goroot to "" to avoid using it later.
 		log.Printf("Unexpected error running \"go env GOROOT\": %v\n%v", err, goroot)
@@ -97,62 +139,124 @@ func newBuildContext(ctx context.Context, dir string) (buildContext, error) {
 	return g, nil
 }
 
-// importPackage wraps go/build.Context Import()
-func (g *goBuildContext) importPackage(path string, srcDir string) (*gb.Package, error) {
+// importPackage wraps go/build.Context Import(). If srcDir is unset, it
+// defaults to the root of the main module that owns g.bc.Dir rather than
+// g.bc.Dir itself, so that source-root discovery resolves against the
+// correct module when g.bc.Dir sits inside one of several main modules in a
+// go.work workspace.
+func (g *goBuildContext) importPackage(ctx context.Context, path string, srcDir string) (*gb.Package, error) {
+	if srcDir == "" {
+		if main, err := g.mainModule(ctx); err == nil {
+			srcDir = main.Dir
+		}
+	}
 	return g.bc.Import(path, srcDir, gb.ImportComment)
 }
 
+// mainModule returns the main module that owns g.bc.Dir, resolving it from
+// the full set of workspace main modules rather than assuming there's only
+// one (see modules.mainModuleForDir).
+func (g *goBuildContext) mainModule(ctx context.Context) (*modInfo, error) {
+	mods, err := g.moduleInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// moduleInfo returns nil modules when it can't determine them (e.g. no
+	// go modules, or a failed `go list`).
+	var main *modInfo
+	if mods != nil {
+		main = mods.mainModuleForDir(g.bc.Dir)
+	}
+	if main == nil {
+		return nil, fmt.Errorf("couldn't find main module owning %s", g.bc.Dir)
+	}
+	return main, nil
+}
+
 // moduleInfo returns the module path and module root directory for a project
 // using go modules, otherwise returns nil.
 //
 // Related: https://github.com/golang/go/issues/26504
 func (g *goBuildContext) moduleInfo(ctx context.Context) (*modules, error) {
-	modules := modules{
-		deps: make(map[string]*modInfo),
+	// `go list -m all` understands `go.work` on its own: when GOWORK points
+	// at a workspace file, it reports one Main:true entry per `use`
+	// directive instead of a single main module. We don't need to parse
+	// go.work ourselves -- we just need to stop assuming there's only one
+	// Main:true entry in the output.
+	if env, err := goEnvVars(ctx); err != nil {
+		log.Printf("Unexpected error running \"go env\": %v", err)
+	} else if goWork := env["GOWORK"]; goWork != "" {
+		log.Printf("using go.work workspace: %s", goWork)
 	}
 
-	// TODO we read all the output as a single byte array - it may
-	// be possible & more efficient to stream it
-	cmd := exec.CommandContext(ctx, "go", "list", "-mod=readonly", "-json", "-m", "all")
-	cmd.Dir = g.bc.Dir
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, nil
-	}
+	return cachedModuleInfo(ctx, g.bc.Dir, func() (*modules, error) {
+		mods := modules{
+			deps: make(map[string]*modInfo),
+		}
 
-	dec := json.NewDecoder(bytes.NewReader(output))
+		// TODO we read all the output as a single byte array - it may
+		// be possible & more efficient to stream it
+		inv := &Invocation{
+			Verb:       "list",
+			Args:       []string{"-json", "-m", "all"},
+			Dir:        g.bc.Dir,
+			BuildFlags: []string{"-mod=readonly"},
+		}
+		stdout, _, err := inv.Run(ctx)
+		if err != nil {
+			return nil, nil
+		}
 
-	for {
-		var info modInfo
+		dec := json.NewDecoder(bytes.NewReader(stdout.Bytes()))
 
-		err := dec.Decode(&info)
-		if err == io.EOF {
-			// all done
-			break
-		}
+		for {
+			var info modInfo
 
-		modules.deps[info.Path] = &info
+			err := dec.Decode(&info)
+			if err == io.EOF {
+				// all done
+				break
+			}
 
-		if info.Main {
-			modules.main = &info
-		}
+			mods.deps[info.Path] = &info
 
-		if err != nil {
-			return nil, fmt.Errorf("error reading module data %w", err)
+			if info.Main {
+				mods.mains = append(mods.mains, &info)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("error reading module data %w", err)
+			}
 		}
-	}
 
-	if modules.main == nil {
-		return nil, fmt.Errorf("couldn't find main module")
-	}
+		if len(mods.mains) == 0 {
+			return nil, fmt.Errorf("couldn't find main module")
+		}
 
-	return &modules, nil
+		return &mods, nil
+	})
 }
 
-func (g *goBuildContext) qualifyLocalImport(importpath string) (string, error) {
+func (g *goBuildContext) qualifyLocalImport(ctx context.Context, importpath string) (string, error) {
+	// Resolve against the main module that actually owns g.bc.Dir, rather
+	// than assuming g.bc.Dir is itself a (or the only) main module root --
+	// in a go.work workspace it may be a subdirectory of one of several.
+	dir := g.bc.Dir
+	if main, err := g.mainModule(ctx); err == nil {
+		dir = main.Dir
+	}
+
 	cfg := &packages.Config{
 		Mode: packages.NeedName,
-		Dir:  g.bc.Dir,
+		Dir:  dir,
+		// Drop any inherited GOFLAGS that might conflict with the flags
+		// packages.Load passes internally. Note: golang.org/x/tools/go/packages
+		// always invokes the "go" binary directly and has no KO_GOCMD hook,
+		// so that override isn't honored here.
+		Env: append(os.Environ(), "GOFLAGS="),
+	}
+	if Verbose {
+		log.Printf("invoking packages.Load(%q) in %s", importpath, dir)
 	}
 	pkgs, err := packages.Load(cfg, importpath)
 	if err != nil {
@@ -164,20 +268,17 @@ func (g *goBuildContext) qualifyLocalImport(importpath string) (string, error) {
 	return pkgs[0].PkgPath, nil
 }
 
-// getGoroot shells out to `go env GOROOT` to determine
-// the GOROOT for the installed version of go so that we
-// can set it in our buildContext. By default, the GOROOT
-// of our buildContext is set to the GOROOT at install
-// time for `ko`, which means that we break when certain
-// package managers update go or when using a pre-built
-// `ko` binary that expects a different GOROOT.
+// getGoroot returns the GOROOT for the installed version of go so that we
+// can set it in our buildContext. By default, the GOROOT of our buildContext
+// is set to the GOROOT at install time for `ko`, which means that we break
+// when certain package managers update go or when using a pre-built `ko`
+// binary that expects a different GOROOT.
 //
 // See https://github.com/google/ko/issues/106
-func getGoroot(ctx context.Context, dir string) (string, error) {
-	cmd := exec.CommandContext(ctx, "go", "env", "GOROOT")
-	// It may not necessary to set the command working directory here,
-	// but it helps keep everything consistent.
-	cmd.Dir = dir
-	output, err := cmd.Output()
-	return strings.TrimSpace(string(output)), err
+func getGoroot(ctx context.Context) (string, error) {
+	env, err := goEnvVars(ctx)
+	if err != nil {
+		return "", err
+	}
+	return env["GOROOT"], nil
 }
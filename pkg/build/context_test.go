@@ -0,0 +1,54 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import "testing"
+
+func TestMainModuleForDir(t *testing.T) {
+	foo := &modInfo{Path: "example.com/foo", Dir: "/ws/foo", Main: true}
+	bar := &modInfo{Path: "example.com/bar", Dir: "/ws/bar", Main: true}
+	api := &modInfo{Path: "example.com/api", Dir: "/ws/api", Main: true}
+	apiGateway := &modInfo{Path: "example.com/api-gateway", Dir: "/ws/api-gateway", Main: true}
+	mods := &modules{mains: []*modInfo{foo, bar, api, apiGateway}}
+
+	tests := []struct {
+		name string
+		dir  string
+		want *modInfo
+	}{
+		{name: "exact match", dir: "/ws/foo", want: foo},
+		{name: "nested package", dir: "/ws/bar/cmd/app", want: bar},
+		{name: "other module", dir: "/ws/foo/internal", want: foo},
+		{name: "no match falls back to first", dir: "/elsewhere", want: foo},
+		{name: "sibling module sharing a string prefix", dir: "/ws/api-gateway/pkg", want: apiGateway},
+		{name: "sibling module reverse prefix", dir: "/ws/api/internal", want: api},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mods.mainModuleForDir(tt.dir); got != tt.want {
+				t.Errorf("mainModuleForDir(%q) = %v, want %v", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMainModuleForDirEmpty(t *testing.T) {
+	mods := &modules{}
+	if got := mods.mainModuleForDir("/ws/foo"); got != nil {
+		t.Errorf("mainModuleForDir() with no mains = %v, want nil", got)
+	}
+}
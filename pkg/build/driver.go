@@ -0,0 +1,223 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	gb "go/build"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// driverBuildContext is a buildContext backed by a GOPACKAGESDRIVER (Bazel's
+// gopackagesdriver, Please, Pants, etc.) instead of go/build and `go list`.
+// It's selected automatically by newBuildContext whenever GOPACKAGESDRIVER
+// is set to anything other than "off", so that `ko` can build binaries whose
+// source isn't described in terms `go list` understands.
+type driverBuildContext struct {
+	dir string
+}
+
+func newDriverBuildContext(dir string) *driverBuildContext {
+	return &driverBuildContext{dir: dir}
+}
+
+// importPackage loads path through the configured packages driver and
+// synthesizes a go/build.Package from the result, so that callers written
+// against go/build.Package keep working unchanged.
+func (d *driverBuildContext) importPackage(ctx context.Context, path string, srcDir string) (*gb.Package, error) {
+	if srcDir == "" {
+		if main, err := d.mainModule(ctx); err == nil {
+			srcDir = main.Dir
+		}
+	}
+
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedImports,
+		Dir:     srcDir,
+		// packages.Load only honors GOPACKAGESDRIVER if it's present in
+		// cfg.Env; a nil Env makes it fall back to searching PATH for a
+		// binary literally named "gopackagesdriver".
+		Env: os.Environ(),
+	}
+	pkgs, err := packages.Load(cfg, path)
+	if err != nil {
+		return nil, fmt.Errorf("loading %q via GOPACKAGESDRIVER: %w", path, err)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("found %d packages for %q via GOPACKAGESDRIVER, expected 1", len(pkgs), path)
+	}
+	pkg := pkgs[0]
+	if len(pkg.Errors) > 0 {
+		return nil, fmt.Errorf("loading %q via GOPACKAGESDRIVER: %v", path, pkg.Errors[0])
+	}
+
+	imports := make([]string, 0, len(pkg.Imports))
+	for imp := range pkg.Imports {
+		imports = append(imports, imp)
+	}
+
+	return &gb.Package{
+		Dir:        packageDir(pkg),
+		ImportPath: pkg.PkgPath,
+		GoFiles:    basenames(pkg.GoFiles),
+		Imports:    imports,
+	}, nil
+}
+
+// packageDir returns the directory containing pkg's source files.
+func packageDir(pkg *packages.Package) string {
+	if len(pkg.GoFiles) > 0 {
+		return filepath.Dir(pkg.GoFiles[0])
+	}
+	return ""
+}
+
+// moduleInfo loads every package matching ./... in d.dir and synthesizes
+// a *modules by walking up from each package's directory to find the go.mod
+// that governs it. pkg.Module is not usable for this: the GOPACKAGESDRIVER
+// wire protocol has no Module field (golang.org/x/tools/go/packages only
+// populates pkg.Module for the in-process go/packages driver), so it's
+// always nil for packages loaded through an external driver.
+func (d *driverBuildContext) moduleInfo(ctx context.Context) (*modules, error) {
+	return cachedModuleInfo(ctx, d.dir, func() (*modules, error) {
+		cfg := &packages.Config{
+			Context: ctx,
+			Mode:    packages.NeedName | packages.NeedFiles | packages.NeedImports,
+			Dir:     d.dir,
+			Env:     os.Environ(),
+		}
+		pkgs, err := packages.Load(cfg, "./...")
+		if err != nil {
+			return nil, fmt.Errorf("loading packages via GOPACKAGESDRIVER: %w", err)
+		}
+
+		mods := modules{deps: make(map[string]*modInfo)}
+		for _, pkg := range pkgs {
+			dir := packageDir(pkg)
+			if dir == "" {
+				continue
+			}
+			modPath, modDir, ok := findModuleRoot(dir)
+			if !ok {
+				continue
+			}
+			if _, ok := mods.deps[modPath]; ok {
+				continue
+			}
+			info := &modInfo{Path: modPath, Dir: modDir, Main: true}
+			mods.deps[info.Path] = info
+			mods.mains = append(mods.mains, info)
+		}
+
+		if len(mods.mains) == 0 {
+			return nil, fmt.Errorf("couldn't find main module via GOPACKAGESDRIVER")
+		}
+
+		return &mods, nil
+	})
+}
+
+// findModuleRoot walks up from dir looking for a go.mod, returning the
+// module path declared by its "module" directive and the directory
+// containing it. It reports ok=false if no go.mod is found before reaching
+// the filesystem root.
+func findModuleRoot(dir string) (modPath, modDir string, ok bool) {
+	for {
+		gomod := filepath.Join(dir, "go.mod")
+		if data, err := os.ReadFile(gomod); err == nil {
+			if path, ok := parseModulePath(data); ok {
+				return path, dir, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// parseModulePath extracts the module path from the "module" directive in
+// the contents of a go.mod file.
+func parseModulePath(gomod []byte) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(gomod))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "module ") {
+			continue
+		}
+		path := strings.TrimSpace(strings.TrimPrefix(line, "module "))
+		path = strings.Trim(path, `"`)
+		if path != "" {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// mainModule returns the main module that owns d.dir, resolving it from the
+// full set of workspace main modules rather than assuming there's only one
+// (see modules.mainModuleForDir).
+func (d *driverBuildContext) mainModule(ctx context.Context) (*modInfo, error) {
+	mods, err := d.moduleInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	main := mods.mainModuleForDir(d.dir)
+	if main == nil {
+		return nil, fmt.Errorf("couldn't find main module owning %s", d.dir)
+	}
+	return main, nil
+}
+
+func (d *driverBuildContext) qualifyLocalImport(ctx context.Context, importpath string) (string, error) {
+	dir := d.dir
+	if main, err := d.mainModule(ctx); err == nil {
+		dir = main.Dir
+	}
+
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName,
+		Dir:     dir,
+		Env:     os.Environ(),
+	}
+	pkgs, err := packages.Load(cfg, importpath)
+	if err != nil {
+		return "", err
+	}
+	if len(pkgs) != 1 {
+		return "", fmt.Errorf("found %d local packages, expected 1", len(pkgs))
+	}
+	return pkgs[0].PkgPath, nil
+}
+
+func basenames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, p := range paths {
+		names[i] = filepath.Base(p)
+	}
+	return names
+}
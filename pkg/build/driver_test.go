@@ -0,0 +1,172 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// writeFakeDriver installs a script on disk that implements the
+// GOPACKAGESDRIVER protocol: it drains the DriverRequest JSON from stdin
+// (ignoring it) and writes the response pointed to by
+// FAKE_DRIVER_RESPONSE_FILE to stdout. It sets GOPACKAGESDRIVER in the
+// test's environment and restores it on cleanup.
+func writeFakeDriver(t *testing.T, response *packages.DriverResponse) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake driver script is a shell script")
+	}
+
+	dir := t.TempDir()
+	resp, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respFile := filepath.Join(dir, "response.json")
+	if err := os.WriteFile(respFile, resp, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	script := filepath.Join(dir, "fakedriver.sh")
+	contents := "#!/bin/sh\ncat >/dev/null\ncat \"" + respFile + "\"\n"
+	if err := os.WriteFile(script, []byte(contents), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GOPACKAGESDRIVER", script)
+}
+
+func TestDriverImportPackage(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeDriver(t, &packages.DriverResponse{
+		Roots: []string{"example.com/foo"},
+		Packages: []*packages.Package{
+			{
+				ID:      "example.com/foo",
+				PkgPath: "example.com/foo",
+				GoFiles: []string{filepath.Join(dir, "foo.go")},
+				Imports: map[string]*packages.Package{"fmt": {ID: "fmt"}},
+			},
+			{ID: "fmt", PkgPath: "fmt"},
+		},
+	})
+
+	d := newDriverBuildContext(dir)
+	pkg, err := d.importPackage(context.Background(), "example.com/foo", dir)
+	if err != nil {
+		t.Fatalf("importPackage() error = %v", err)
+	}
+	if pkg.ImportPath != "example.com/foo" {
+		t.Errorf("ImportPath = %q, want %q", pkg.ImportPath, "example.com/foo")
+	}
+	if pkg.Dir != dir {
+		t.Errorf("Dir = %q, want %q", pkg.Dir, dir)
+	}
+	if want := []string{"foo.go"}; len(pkg.GoFiles) != 1 || pkg.GoFiles[0] != want[0] {
+		t.Errorf("GoFiles = %v, want %v", pkg.GoFiles, want)
+	}
+	if len(pkg.Imports) != 1 || pkg.Imports[0] != "fmt" {
+		t.Errorf("Imports = %v, want [fmt]", pkg.Imports)
+	}
+}
+
+func TestDriverImportPackagePropagatesPackageErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeDriver(t, &packages.DriverResponse{
+		Roots: []string{"example.com/foo"},
+		Packages: []*packages.Package{{
+			ID:      "example.com/foo",
+			PkgPath: "example.com/foo",
+			Errors:  []packages.Error{{Msg: "boom"}},
+		}},
+	})
+
+	d := newDriverBuildContext(dir)
+	if _, err := d.importPackage(context.Background(), "example.com/foo", dir); err == nil {
+		t.Fatal("importPackage() error = nil, want an error for a package with Errors set")
+	}
+}
+
+func TestDriverImportPackageWrongPackageCount(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, pkgs := range map[string][]*packages.Package{
+		"zero":  {},
+		"multi": {{ID: "a", PkgPath: "a"}, {ID: "b", PkgPath: "b"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			roots := make([]string, 0, len(pkgs))
+			for _, pkg := range pkgs {
+				roots = append(roots, pkg.ID)
+			}
+			writeFakeDriver(t, &packages.DriverResponse{Roots: roots, Packages: pkgs})
+
+			d := newDriverBuildContext(dir)
+			if _, err := d.importPackage(context.Background(), "example.com/foo", dir); err == nil {
+				t.Fatalf("importPackage() error = nil, want an error for %d packages", len(pkgs))
+			}
+		})
+	}
+}
+
+func TestDriverModuleInfo(t *testing.T) {
+	root, pkgDir := newTestModule(t)
+	writeFakeDriver(t, &packages.DriverResponse{
+		Roots: []string{"example.com/testmod/pkg/sub"},
+		Packages: []*packages.Package{{
+			ID:      "example.com/testmod/pkg/sub",
+			PkgPath: "example.com/testmod/pkg/sub",
+			GoFiles: []string{filepath.Join(pkgDir, "sub.go")},
+		}},
+	})
+
+	d := newDriverBuildContext(pkgDir)
+	mods, err := d.moduleInfo(context.Background())
+	if err != nil {
+		t.Fatalf("moduleInfo() error = %v", err)
+	}
+	if len(mods.mains) != 1 {
+		t.Fatalf("mains = %v, want exactly one main module", mods.mains)
+	}
+	if got := mods.mains[0]; got.Path != "example.com/testmod" || got.Dir != root {
+		t.Errorf("main module = %+v, want Path=example.com/testmod Dir=%s", got, root)
+	}
+}
+
+func TestDriverModuleInfoNoModuleFound(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeDriver(t, &packages.DriverResponse{
+		Roots: []string{"example.com/foo"},
+		Packages: []*packages.Package{{
+			ID:      "example.com/foo",
+			PkgPath: "example.com/foo",
+			GoFiles: []string{filepath.Join(dir, "foo.go")},
+		}},
+	})
+
+	d := newDriverBuildContext(dir)
+	if _, err := d.moduleInfo(context.Background()); err == nil {
+		t.Fatal("moduleInfo() error = nil, want an error when no go.mod is found above any package")
+	}
+}
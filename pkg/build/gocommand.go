@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Verbose gates trace logging of every `go` invocation made through
+// Invocation.Run. It's wired up to ko's top-level `-v` flag.
+var Verbose bool
+
+// gocmd is the name (or path) of the go binary to invoke. It defaults to
+// "go", but can be overridden with the KO_GOCMD environment variable, e.g.
+// to pin a specific toolchain or point at a wrapper script.
+func gocmd() string {
+	if gocmd := os.Getenv("KO_GOCMD"); gocmd != "" {
+		return gocmd
+	}
+	return "go"
+}
+
+// Invocation describes a single invocation of the `go` command, modeled
+// after golang.org/x/tools/internal/gocommand.Invocation. It centralizes the
+// stderr capture, GOFLAGS scrubbing, working-directory handling, and debug
+// tracing for getGoroot and moduleInfo. qualifyLocalImport does not use it:
+// it calls packages.Load, which runs `go` itself, and does its own GOFLAGS
+// scrubbing and tracing.
+type Invocation struct {
+	Verb       string
+	Args       []string
+	Env        []string
+	Dir        string
+	BuildFlags []string
+}
+
+// Run runs the invocation, retrying once if the initial attempt fails with a
+// transient "go: downloading" module-cache race.
+func (i *Invocation) Run(ctx context.Context) (stdout, stderr bytes.Buffer, err error) {
+	stdout, stderr, err = i.run(ctx)
+	if err != nil && strings.Contains(stderr.String(), "go: downloading") {
+		stdout.Reset()
+		stderr.Reset()
+		stdout, stderr, err = i.run(ctx)
+	}
+	return stdout, stderr, err
+}
+
+func (i *Invocation) run(ctx context.Context) (stdout, stderr bytes.Buffer, err error) {
+	args := []string{i.Verb}
+	args = append(args, i.BuildFlags...)
+	args = append(args, i.Args...)
+
+	cmd := exec.CommandContext(ctx, gocmd(), args...)
+	cmd.Dir = i.Dir
+	cmd.Env = append(os.Environ(), i.Env...)
+	// GOFLAGS can carry flags left over from an enclosing `go` invocation
+	// (e.g. -mod=mod from a test harness) that conflict with the ones we
+	// pass explicitly; scrub it so our args are the only source of truth.
+	// Skip this for `go env` itself -- scrubbing GOFLAGS there would make
+	// every caller that asks "what is GOFLAGS" get back an empty string
+	// regardless of what's actually configured.
+	if i.Verb != "env" {
+		cmd.Env = append(cmd.Env, "GOFLAGS=")
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if Verbose {
+		log.Printf("invoking %s", i.cmdString())
+		start := time.Now()
+		defer func() { log.Printf("%s took %v", i.cmdString(), time.Since(start)) }()
+	}
+
+	if err := cmd.Run(); err != nil {
+		return stdout, stderr, fmt.Errorf("running %s: %w\n%s", i.cmdString(), err, stderr.String())
+	}
+	return stdout, stderr, nil
+}
+
+func (i *Invocation) cmdString() string {
+	args := append([]string{gocmd(), i.Verb}, i.BuildFlags...)
+	args = append(args, i.Args...)
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Google LLC All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeGocmd writes a shell script standing in for `go` and points KO_GOCMD
+// at it for the duration of the test.
+func fakeGocmd(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fakego.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KO_GOCMD", path)
+}
+
+func TestInvocationRunRetriesOnDownloadingRace(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "attempts")
+	fakeGocmd(t, fmt.Sprintf(`
+count=0
+[ -f %q ] && count=$(cat %q)
+count=$((count+1))
+echo "$count" > %q
+if [ "$count" -eq 1 ]; then
+  echo "go: downloading example.com/foo" >&2
+  exit 1
+fi
+echo ok
+`, counter, counter, counter))
+
+	inv := &Invocation{Verb: "list", Args: []string{"./..."}}
+	stdout, _, err := inv.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() returned error after expected retry: %v", err)
+	}
+	if got := stdout.String(); got != "ok\n" {
+		t.Errorf("stdout = %q, want %q", got, "ok\n")
+	}
+}
+
+func TestInvocationRunDoesNotRetryOnOtherErrors(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "attempts")
+	fakeGocmd(t, fmt.Sprintf(`printf x >> %q; echo "boom" >&2; exit 1`, counter))
+
+	inv := &Invocation{Verb: "list"}
+	_, _, err := inv.Run(context.Background())
+	if err == nil {
+		t.Fatal("Run() = nil error, want error")
+	}
+	attempts, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(attempts); got != 1 {
+		t.Errorf("go was invoked %d times, want 1 (no retry)", got)
+	}
+}
+
+func TestInvocationRunScrubsGOFLAGSForBuildCommands(t *testing.T) {
+	t.Setenv("GOFLAGS", "-mod=mod")
+	fakeGocmd(t, `echo "GOFLAGS=[$GOFLAGS]"`)
+
+	inv := &Invocation{Verb: "list"}
+	stdout, _, err := inv.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "GOFLAGS=[]\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestInvocationRunPreservesGOFLAGSForEnvCommand(t *testing.T) {
+	t.Setenv("GOFLAGS", "-mod=mod")
+	fakeGocmd(t, `echo "GOFLAGS=[$GOFLAGS]"`)
+
+	inv := &Invocation{Verb: "env"}
+	stdout, _, err := inv.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "GOFLAGS=[-mod=mod]\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+}